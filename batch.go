@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+)
+
+// Batch is a slice of rows to apply together, tagged with an ID so log
+// lines for its rows can be correlated back to the statement that applied
+// them.
+type Batch struct {
+	ID   int64
+	Rows []Merchant
+}
+
+// runStats accumulates row counts across all workers for the final
+// summary record. All fields are updated with atomic operations since
+// workers run concurrently.
+type runStats struct {
+	updated int64
+	skipped int64
+	errored int64
+}
+
+// batchMerchants groups rows arriving on in into Batches of at most
+// batchSize, flushing whatever is left once in is closed. This lets
+// updateBranchCountBatch issue one bulk UPSERT per batch instead of one
+// round-trip per row.
+func batchMerchants(in <-chan Merchant, out chan<- Batch, batchSize int) {
+	defer close(out)
+
+	var batchID int64
+	rows := make([]Merchant, 0, batchSize)
+	for merchant := range in {
+		rows = append(rows, merchant)
+		if len(rows) >= batchSize {
+			out <- Batch{ID: batchID, Rows: rows}
+			batchID++
+			rows = make([]Merchant, 0, batchSize)
+		}
+	}
+
+	if len(rows) > 0 {
+		out <- Batch{ID: batchID, Rows: rows}
+	}
+}
+
+// filterExistingMerchants splits rows into those whose retailer_id already
+// exists in the table and those that don't. Only the former may be passed
+// to the bulk OnConflict upsert: the original SELECT+UPDATE path never
+// created a row for an unknown retailer_id, and ON CONFLICT's insert path
+// would otherwise do exactly that for any retailer_id not already present.
+func filterExistingMerchants(ctx context.Context, db *gorm.DB, rows []Merchant) (existing []Merchant, notFound []Merchant, err error) {
+	ids := make([]int64, len(rows))
+	for i, m := range rows {
+		ids[i] = m.RetailerID
+	}
+
+	var foundIDs []int64
+	if err := db.WithContext(ctx).Table(tableName).Where("retailer_id IN ?", ids).Pluck("retailer_id", &foundIDs).Error; err != nil {
+		return nil, nil, err
+	}
+
+	foundSet := make(map[int64]struct{}, len(foundIDs))
+	for _, id := range foundIDs {
+		foundSet[id] = struct{}{}
+	}
+
+	for _, m := range rows {
+		if _, ok := foundSet[m.RetailerID]; ok {
+			existing = append(existing, m)
+		} else {
+			notFound = append(notFound, m)
+		}
+	}
+
+	return existing, notFound, nil
+}
+
+// worker applies batches off batches until the channel is closed,
+// committing the checkpoint for every row in a batch once it has been
+// applied, skipped as already-set, or skipped as not-found. Running
+// several workers lets independent batches be applied concurrently,
+// subject to limiter (token-bucket QPS cap) and aimd (adaptive
+// concurrency, backed off on repeated deadlocks). ctx is attached to
+// every DB call so a cancelled run (e.g. Ctrl-C) unblocks in-flight
+// statements instead of hanging.
+func worker(ctx context.Context, db *gorm.DB, batches <-chan Batch, ckpt Checkpointer, stats *runStats, wg *sync.WaitGroup, log *logrus.Logger, limiter *rate.Limiter, retryCfg retryConfig, aimd *adaptiveConcurrency) {
+	defer wg.Done()
+
+	for batch := range batches {
+		batchStart := time.Now()
+		log.WithField("batch_id", batch.ID).Infof("Applying batch of %d rows", len(batch.Rows))
+
+		if err := aimd.acquire(ctx); err != nil {
+			log.WithField("batch_id", batch.ID).Errorf("Error waiting for a concurrency slot: %+v", err)
+			atomic.AddInt64(&stats.errored, int64(len(batch.Rows)))
+			rowErrors.WithLabelValues("db").Add(float64(len(batch.Rows)))
+			batchDuration.Observe(time.Since(batchStart).Seconds())
+			continue
+		}
+
+		var existing, notFound []Merchant
+		var rowsAffected int64
+		dbStart := time.Now()
+		err := withRetry(ctx, retryCfg, aimd, log, batch.ID, func() error {
+			if limiter != nil {
+				if err := limiter.Wait(ctx); err != nil {
+					return err
+				}
+			}
+
+			var ferr error
+			existing, notFound, ferr = filterExistingMerchants(ctx, db, batch.Rows)
+			if ferr != nil {
+				return ferr
+			}
+			if len(existing) == 0 {
+				rowsAffected = 0
+				return nil
+			}
+
+			result := db.WithContext(ctx).Table(tableName).Clauses(buildOnConflict()).CreateInBatches(existing, len(existing))
+			rowsAffected = result.RowsAffected
+			return result.Error
+		})
+		aimd.release()
+		dbLatency.Observe(time.Since(dbStart).Seconds())
+
+		if err != nil {
+			log.WithField("batch_id", batch.ID).Errorf("Error updating batch: %+v", err)
+			atomic.AddInt64(&stats.errored, int64(len(batch.Rows)))
+			rowErrors.WithLabelValues("db").Add(float64(len(batch.Rows)))
+			batchDuration.Observe(time.Since(batchStart).Seconds())
+			continue
+		}
+
+		for _, merchant := range notFound {
+			log.WithFields(logrus.Fields{
+				"retailer_id": merchant.RetailerID,
+				"batch_id":    batch.ID,
+			}).Warn("Retailer ID not found, skipping")
+		}
+
+		alreadySet := int64(len(existing)) - rowsAffected
+
+		atomic.AddInt64(&stats.updated, rowsAffected)
+		atomic.AddInt64(&stats.skipped, alreadySet+int64(len(notFound)))
+		rowsUpdated.Add(float64(rowsAffected))
+		rowsSkipped.WithLabelValues("already_set").Add(float64(alreadySet))
+		rowsSkipped.WithLabelValues("not_found").Add(float64(len(notFound)))
+
+		for _, merchant := range batch.Rows {
+			log.WithFields(logrus.Fields{
+				"retailer_id": merchant.RetailerID,
+				"offset":      merchant.Offset,
+				"batch_id":    batch.ID,
+			}).Debug("Row applied")
+
+			if err := ckpt.Commit(merchant.Offset, merchant.RetailerID); err != nil {
+				log.WithField("retailer_id", merchant.RetailerID).Errorf("Cannot commit checkpoint: %+v", err)
+			}
+		}
+
+		batchDuration.Observe(time.Since(batchStart).Seconds())
+	}
+}
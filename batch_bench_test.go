@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// benchDB returns a *gorm.DB backed by a sqlmock connection, so the two
+// benchmarks below measure statement count and query-building overhead
+// rather than real network/MySQL latency - the thing CreateInBatches was
+// introduced to cut down on.
+func benchDB(b *testing.B) (*gorm.DB, sqlmock.Sqlmock) {
+	b.Helper()
+
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("sqlmock.New: %v", err)
+	}
+	b.Cleanup(func() {
+		mock.ExpectClose()
+		if err := sqlDB.Close(); err != nil {
+			b.Errorf("sqlDB.Close: %v", err)
+		}
+	})
+
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		Conn:                      sqlDB,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{})
+	if err != nil {
+		b.Fatalf("gorm.Open: %v", err)
+	}
+
+	return db, mock
+}
+
+func benchRows(n int) []Merchant {
+	rows := make([]Merchant, n)
+	for i := range rows {
+		branchCount := int32(i)
+		rows[i] = Merchant{RetailerID: int64(i) + 1, BranchCount: &branchCount}
+	}
+	return rows
+}
+
+// BenchmarkBulkUpsert measures the chunk0-2 path: one OnConflict UPSERT
+// per batch via CreateInBatches.
+func BenchmarkBulkUpsert(b *testing.B) {
+	rows := benchRows(defaultBatchSize)
+	db, mock := benchDB(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO `merchant`").WillReturnResult(sqlmock.NewResult(0, int64(len(rows))))
+		mock.ExpectCommit()
+
+		if err := db.Table(tableName).Clauses(buildOnConflict()).CreateInBatches(rows, len(rows)).Error; err != nil {
+			b.Fatalf("bulk upsert: %v", err)
+		}
+	}
+}
+
+// BenchmarkPerRowUpdate measures the SELECT-then-UPDATE path this script
+// used before chunk0-2 (see updateBranchCount in the pre-chunk0-2 history),
+// as the baseline the bulk path above is meant to beat.
+func BenchmarkPerRowUpdate(b *testing.B) {
+	rows := benchRows(defaultBatchSize)
+	db, mock := benchDB(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, row := range rows {
+			cond := clause.Eq{Column: "retailer_id", Value: row.RetailerID}
+
+			mock.ExpectQuery("SELECT").WillReturnRows(
+				sqlmock.NewRows([]string{"retailer_id", "branch_count", "expire_at"}).
+					AddRow(row.RetailerID, nil, time.Time{}),
+			)
+			mock.ExpectBegin()
+			mock.ExpectExec("UPDATE `merchant`").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			existing := new(Merchant)
+			if err := db.Table(tableName).Clauses(cond).Take(existing).Error; err != nil {
+				b.Fatalf("select: %v", err)
+			}
+			if err := db.Table(tableName).Clauses(cond).Update(columnName, *row.BranchCount).Error; err != nil {
+				b.Fatalf("update: %v", err)
+			}
+		}
+	}
+}
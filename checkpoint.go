@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Checkpointer records progress through a batch run so that, after a crash
+// or restart, already-applied rows are not updated twice and unapplied rows
+// are not skipped. Implementations must be safe for concurrent use.
+type Checkpointer interface {
+	// Commit marks the row identified by offset/retailerID as applied.
+	// It is called only after the DB update for that row has been
+	// acknowledged.
+	Commit(offset int64, retailerID int64) error
+	// Done reports whether offset was committed in a previous run.
+	Done(offset int64) bool
+	// Close releases any resources held by the checkpointer.
+	Close() error
+}
+
+func checkpointPath(path string) string {
+	return path + ".ckpt"
+}
+
+// fileCheckpointer is the default Checkpointer. It appends one
+// "offset,retailer_id" line per committed row to a local file and replays
+// that file on startup to know what to skip. The offset is the row's
+// position in the input stream (its line number), which is what fileLoader
+// can cheaply hand back on resume.
+type fileCheckpointer struct {
+	mu        sync.Mutex
+	file      *os.File
+	committed map[int64]struct{}
+}
+
+// newFileCheckpointer opens (creating if necessary) the checkpoint file for
+// path and loads the offsets already committed by a previous run.
+func newFileCheckpointer(path string) (*fileCheckpointer, error) {
+	ckptPath := checkpointPath(path)
+
+	committed := make(map[int64]struct{})
+
+	if existing, err := os.Open(ckptPath); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), ",", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			offset, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				continue
+			}
+			committed[offset] = struct{}{}
+		}
+		closeErr := existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		if closeErr != nil {
+			return nil, closeErr
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(ckptPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileCheckpointer{file: file, committed: committed}, nil
+}
+
+func (c *fileCheckpointer) Commit(offset int64, retailerID int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(c.file, "%d,%d\n", offset, retailerID); err != nil {
+		return err
+	}
+	c.committed[offset] = struct{}{}
+
+	return nil
+}
+
+func (c *fileCheckpointer) Done(offset int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.committed[offset]
+	return ok
+}
+
+func (c *fileCheckpointer) Close() error {
+	return c.file.Close()
+}
+
+// noopCheckpointer is used when --resume is not requested: nothing is
+// persisted and no offset is ever considered done.
+type noopCheckpointer struct{}
+
+func (noopCheckpointer) Commit(offset int64, retailerID int64) error { return nil }
+func (noopCheckpointer) Done(offset int64) bool                      { return false }
+func (noopCheckpointer) Close() error                                { return nil }
+
+// newCheckpointer builds the Checkpointer to use for this run. When resume
+// is false the checkpoint file is left untouched and every row is treated
+// as new, matching the tool's previous one-shot behaviour.
+func newCheckpointer(resume bool, path string) (Checkpointer, error) {
+	if !resume {
+		return noopCheckpointer{}, nil
+	}
+
+	return newFileCheckpointer(path)
+}
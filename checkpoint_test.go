@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestFileCheckpointerResumeAfterMidBatchCrash simulates a process killed
+// partway through a run: one batch of rows finished and had its
+// checkpoint committed, a second batch was in flight against MySQL when
+// the process died, so none of its rows were ever committed. On resume,
+// a fresh fileCheckpointer over the same path must report the finished
+// batch's offsets as done (so worker never re-applies them, i.e. no row
+// is updated twice) and the in-flight batch's offsets as not done (so
+// fileLoader re-sends them instead of silently skipping them).
+func TestFileCheckpointerResumeAfterMidBatchCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.csv")
+
+	ckpt, err := newFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("newFileCheckpointer: %v", err)
+	}
+
+	finishedBatch := []int64{0, 1, 2}
+	for _, offset := range finishedBatch {
+		if err := ckpt.Commit(offset, offset+100); err != nil {
+			t.Fatalf("Commit(%d): %v", offset, err)
+		}
+	}
+
+	inFlightBatch := []int64{3, 4, 5}
+
+	// The process is killed here, before any offset in inFlightBatch is
+	// committed. Do not call ckpt.Close via defer: a crash doesn't get
+	// to run deferred cleanup either.
+
+	resumed, err := newFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("newFileCheckpointer on resume: %v", err)
+	}
+	defer func() {
+		if err := resumed.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}()
+
+	for _, offset := range finishedBatch {
+		if !resumed.Done(offset) {
+			t.Errorf("offset %d from the finished batch must be Done after resume (would otherwise be updated twice)", offset)
+		}
+	}
+
+	for _, offset := range inFlightBatch {
+		if resumed.Done(offset) {
+			t.Errorf("offset %d from the crashed batch must not be Done after resume (would otherwise be silently skipped)", offset)
+		}
+	}
+}
+
+// TestNoopCheckpointerNeverResumes documents the contrast with
+// fileCheckpointer: without --resume, every offset is always treated as
+// new, matching the tool's one-shot default behaviour.
+func TestNoopCheckpointerNeverResumes(t *testing.T) {
+	ckpt, err := newCheckpointer(false, filepath.Join(t.TempDir(), "input.csv"))
+	if err != nil {
+		t.Fatalf("newCheckpointer: %v", err)
+	}
+
+	if err := ckpt.Commit(0, 1); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if ckpt.Done(0) {
+		t.Error("noopCheckpointer must never report an offset as Done")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Decision is the outcome the dry-run report records for a single row:
+// what updateBranchCountBatch would have done had --dry-run not been set.
+type Decision string
+
+const (
+	WillUpdate     Decision = "WILL_UPDATE"
+	SkipAlreadySet Decision = "SKIP_ALREADY_SET"
+	NotFound       Decision = "NOT_FOUND"
+)
+
+// PlannedChange is one row of the dry-run report.
+type PlannedChange struct {
+	RetailerID          int64    `json:"retailer_id"`
+	CurrentBranchCount  *int32   `json:"current_branch_count"`
+	ProposedBranchCount int32    `json:"proposed_branch_count"`
+	Decision            Decision `json:"decision"`
+}
+
+// reportSink writes the dry-run report, as CSV or as newline-delimited
+// JSON depending on the file extension of path. CSV is the default.
+type reportSink struct {
+	mu     sync.Mutex
+	file   *os.File
+	csvW   *csv.Writer
+	isJSON bool
+}
+
+func newReportSink(path string) (*reportSink, error) {
+	if path == "" {
+		path = "dry_run_report.csv"
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &reportSink{file: file, isJSON: strings.EqualFold(filepath.Ext(path), ".json")}
+	if !sink.isJSON {
+		sink.csvW = csv.NewWriter(file)
+		if err := sink.csvW.Write([]string{"retailer_id", "current_branch_count", "proposed_branch_count", "decision"}); err != nil {
+			return nil, err
+		}
+		sink.csvW.Flush()
+	}
+
+	return sink, nil
+}
+
+func (s *reportSink) Write(change PlannedChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isJSON {
+		return json.NewEncoder(s.file).Encode(change)
+	}
+
+	current := "<nil>"
+	if change.CurrentBranchCount != nil {
+		current = strconv.FormatInt(int64(*change.CurrentBranchCount), 10)
+	}
+
+	if err := s.csvW.Write([]string{
+		strconv.FormatInt(change.RetailerID, 10),
+		current,
+		strconv.FormatInt(int64(change.ProposedBranchCount), 10),
+		string(change.Decision),
+	}); err != nil {
+		return err
+	}
+	s.csvW.Flush()
+
+	return s.csvW.Error()
+}
+
+func (s *reportSink) Close() error {
+	if s.csvW != nil {
+		s.csvW.Flush()
+	}
+	return s.file.Close()
+}
+
+// planBatch runs the read-only path for a batch: for each row, SELECT the
+// current branch_count and record the decision updateBranchCountBatch
+// would have made, without issuing any UPDATE. limiter, if set, is
+// consulted once per batch, the same as on the real run path (one UPSERT
+// statement per batch there, one SELECT loop per batch here) - so db.qps
+// means "batches per second" identically in both modes, not "rows per
+// second" in one and "batches per second" in the other.
+func planBatch(ctx context.Context, db *gorm.DB, batch Batch, report *reportSink, limiter *rate.Limiter) error {
+	if limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, merchant := range batch.Rows {
+		existing := new(Merchant)
+		cond := clause.Eq{Column: "retailer_id", Value: merchant.RetailerID}
+
+		err := db.WithContext(ctx).Table(tableName).Clauses(cond).Take(existing).Error
+
+		change := PlannedChange{RetailerID: merchant.RetailerID, ProposedBranchCount: *merchant.BranchCount}
+
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			change.Decision = NotFound
+			rowsSkipped.WithLabelValues("not_found").Inc()
+		case err != nil:
+			return err
+		case existing.BranchCount == nil:
+			change.Decision = WillUpdate
+		default:
+			change.CurrentBranchCount = existing.BranchCount
+			change.Decision = SkipAlreadySet
+			rowsSkipped.WithLabelValues("already_set").Inc()
+		}
+
+		if err := report.Write(change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dryRunWorker is the --dry-run counterpart of worker: it plans each
+// batch against the report sink instead of applying it.
+func dryRunWorker(ctx context.Context, db *gorm.DB, batches <-chan Batch, report *reportSink, wg *sync.WaitGroup, log *logrus.Logger, limiter *rate.Limiter) {
+	defer wg.Done()
+
+	for batch := range batches {
+		log.WithField("batch_id", batch.ID).Infof("Planning batch of %d rows (dry run)", len(batch.Rows))
+
+		if err := planBatch(ctx, db, batch, report, limiter); err != nil {
+			log.WithField("batch_id", batch.ID).Errorf("Error planning batch: %+v", err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// InputSource streams Merchant records from some underlying medium (CSV
+// file, newline-delimited JSON, or stdin). Next returns io.EOF once the
+// source is exhausted. A malformed record is reported as a *recordError
+// rather than aborting the stream, so the caller can route it to the
+// reject sink and keep reading.
+type InputSource interface {
+	Next() (Merchant, error)
+	Close() error
+}
+
+// recordError marks a row that failed to parse into a Merchant. It is
+// never a reason to abort the run; the row is instead sent to the
+// reject-file sink.
+type recordError struct {
+	raw    string
+	reason string
+}
+
+func (e *recordError) Error() string {
+	return e.reason
+}
+
+// newInputSource opens filePath (ignored for "stdin") and returns the
+// InputSource that decodes it according to format.
+func newInputSource(format, path string) (InputSource, error) {
+	switch format {
+	case "stdin":
+		return newCSVInputSource(os.Stdin, nil), nil
+	case "jsonl":
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return newJSONLInputSource(file, file), nil
+	case "csv", "":
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return newCSVInputSource(file, file), nil
+	default:
+		return nil, fmt.Errorf("unsupported input format %q", format)
+	}
+}
+
+// csvInputSource reads "retailer_id,branch_count" rows, the tool's
+// original format.
+type csvInputSource struct {
+	closer io.Closer
+	reader *csv.Reader
+	offset int64
+}
+
+func newCSVInputSource(r io.Reader, closer io.Closer) *csvInputSource {
+	return &csvInputSource{closer: closer, reader: csv.NewReader(r)}
+}
+
+func (s *csvInputSource) Next() (Merchant, error) {
+	line, err := s.reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return Merchant{}, io.EOF
+		}
+
+		// A row with the wrong number of fields (e.g. a trailing or
+		// missing column in a malformed export) surfaces as a
+		// *csv.ParseError. The csv.Reader resynchronizes on its own and
+		// is safe to keep reading from, so reject the row instead of
+		// aborting the whole run.
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			offset := s.offset
+			s.offset++
+			return Merchant{Offset: offset}, &recordError{
+				raw:    strings.Join(line, ","),
+				reason: "malformed CSV row: " + parseErr.Error(),
+			}
+		}
+
+		return Merchant{}, err
+	}
+
+	offset := s.offset
+	s.offset++
+
+	if len(line) < 2 {
+		return Merchant{Offset: offset}, &recordError{
+			raw:    strings.Join(line, ","),
+			reason: "expected 2 columns: retailer_id,branch_count",
+		}
+	}
+
+	retailerID, err := strconv.ParseInt(line[0], 10, 64)
+	if err != nil {
+		return Merchant{Offset: offset}, &recordError{
+			raw:    strings.Join(line, ","),
+			reason: "invalid retailer_id: " + err.Error(),
+		}
+	}
+
+	branchCountInt64, err := strconv.ParseInt(line[1], 10, 64)
+	if err != nil {
+		return Merchant{Offset: offset}, &recordError{
+			raw:    strings.Join(line, ","),
+			reason: "invalid branch_count: " + err.Error(),
+		}
+	}
+	branchCount := int32(branchCountInt64)
+
+	return Merchant{RetailerID: retailerID, BranchCount: &branchCount, Offset: offset}, nil
+}
+
+func (s *csvInputSource) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// jsonlInputSource reads one {"retailer_id":...,"branch_count":...} object
+// per line.
+type jsonlInputSource struct {
+	closer  io.Closer
+	scanner *bufio.Scanner
+	offset  int64
+}
+
+func newJSONLInputSource(r io.Reader, closer io.Closer) *jsonlInputSource {
+	return &jsonlInputSource{closer: closer, scanner: bufio.NewScanner(r)}
+}
+
+func (s *jsonlInputSource) Next() (Merchant, error) {
+	if !s.scanner.Scan() {
+		if err := s.scanner.Err(); err != nil {
+			return Merchant{}, err
+		}
+		return Merchant{}, io.EOF
+	}
+
+	offset := s.offset
+	s.offset++
+	line := s.scanner.Text()
+
+	var raw struct {
+		RetailerID  int64  `json:"retailer_id"`
+		BranchCount *int32 `json:"branch_count"`
+	}
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return Merchant{Offset: offset}, &recordError{raw: line, reason: "invalid JSON: " + err.Error()}
+	}
+
+	return Merchant{RetailerID: raw.RetailerID, BranchCount: raw.BranchCount, Offset: offset}, nil
+}
+
+func (s *jsonlInputSource) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// validateMerchant enforces the declared schema: retailer_id must be
+// present and non-zero, branch_count must be present and non-negative.
+func validateMerchant(m Merchant) error {
+	if m.RetailerID == 0 {
+		return fmt.Errorf("retailer_id must be non-zero")
+	}
+	if m.BranchCount == nil {
+		return fmt.Errorf("branch_count is required")
+	}
+	if *m.BranchCount < 0 {
+		return fmt.Errorf("branch_count must not be negative")
+	}
+	return nil
+}
+
+func formatBranchCount(v *int32) string {
+	if v == nil {
+		return "<nil>"
+	}
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+// rejectSink records rows that fail parsing or schema validation, along
+// with the reason, so they can be inspected and re-submitted after
+// cleanup instead of being silently dropped. A nil *rejectSink is valid
+// and simply discards rejects.
+type rejectSink struct {
+	mu     sync.Mutex
+	writer *csv.Writer
+	file   *os.File
+}
+
+func newRejectSink(path string) (*rejectSink, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rejectSink{writer: csv.NewWriter(file), file: file}, nil
+}
+
+func (s *rejectSink) Reject(offset int64, raw, reason string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writer.Write([]string{strconv.FormatInt(offset, 10), raw, reason}); err != nil {
+		return err
+	}
+	s.writer.Flush()
+
+	return s.writer.Error()
+}
+
+func (s *rejectSink) Close() error {
+	if s == nil || s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestCSVInputSourceRejectsWrongFieldCount exercises a row with a
+// different field count than the header row (a plausible malformed
+// export), which encoding/csv reports as a *csv.ParseError rather than
+// letting csvInputSource's len(line) < 2 check catch it. That error must
+// be converted into a *recordError so fileLoader routes the row to the
+// reject sink and keeps reading, instead of aborting the whole run.
+func TestCSVInputSourceRejectsWrongFieldCount(t *testing.T) {
+	src := newCSVInputSource(strings.NewReader("1,5\n2\n3,6\n"), nil)
+
+	first, err := src.Next()
+	if err != nil {
+		t.Fatalf("row 1: unexpected error: %v", err)
+	}
+	if first.RetailerID != 1 {
+		t.Errorf("row 1: RetailerID = %d, want 1", first.RetailerID)
+	}
+
+	_, err = src.Next()
+	var recErr *recordError
+	if !errors.As(err, &recErr) {
+		t.Fatalf("row 2: got error %v (%T), want a *recordError", err, err)
+	}
+
+	third, err := src.Next()
+	if err != nil {
+		t.Fatalf("row 3: unexpected error: %v", err)
+	}
+	if third.RetailerID != 3 {
+		t.Errorf("row 3: RetailerID = %d, want 3", third.RetailerID)
+	}
+
+	if _, err := src.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("final read: err = %v, want io.EOF", err)
+	}
+}
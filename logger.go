@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+	"github.com/rifflock/lfshook"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	logDir        = "log"
+	logFile       = logDir + "/update-branch.log"
+	logMaxAge     = 7 * 24 * time.Hour
+	logRotateTime = 24 * time.Hour
+)
+
+// newLogger builds the logger used for a run: JSON output, level taken
+// from log.level in config, and daily rotation with a 7 day retention,
+// symlinked to log/update-branch.log. The logger is injected into the call
+// chain rather than accessed through the logrus package global so tests
+// can capture its output.
+func newLogger() (*logrus.Logger, error) {
+	log := logrus.New()
+	log.SetFormatter(&logrus.JSONFormatter{})
+	log.SetOutput(os.Stdout)
+
+	level, err := logrus.ParseLevel(viper.GetString("log.level"))
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	log.SetLevel(level)
+
+	writer, err := rotatelogs.New(
+		logFile+".%Y%m%d",
+		rotatelogs.WithLinkName(logFile),
+		rotatelogs.WithMaxAge(logMaxAge),
+		rotatelogs.WithRotationTime(logRotateTime),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.AddHook(lfshook.NewHook(lfshook.WriterMap{
+		logrus.DebugLevel: writer,
+		logrus.InfoLevel:  writer,
+		logrus.WarnLevel:  writer,
+		logrus.ErrorLevel: writer,
+		logrus.FatalLevel: writer,
+		logrus.PanicLevel: writer,
+	}, &logrus.JSONFormatter{}))
+
+	return log, nil
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"os"
-	"strconv"
+	"os/signal"
 	"sync"
+	"syscall"
+	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -21,6 +24,7 @@ type Merchant struct {
 	RetailerID  int64     `gorm:"column:retailer_id;" json:"retailer_id"`
 	BranchCount *int32    `gorm:"branch_count" json:"branch_count"`
 	ExpireAt    time.Time `gorm:"column:expire_at;" json:"expire_at"`
+	Offset      int64     `gorm:"-" json:"-"`
 }
 
 const (
@@ -28,12 +32,33 @@ const (
 	defaultMaxIdleConns    = 5
 	defaultMaxConnLifeTime = time.Hour
 	defaultMaxConnIdleTime = 30 * time.Minute
+
+	defaultBatchSize = 500
+	defaultWorkers   = 4
 )
 
 var (
 	filePath   = "retail.csv"
 	tableName  = "merchant"
 	columnName = "branch_count"
+	resume     bool
+
+	inputFileFlag   string
+	inputFormatFlag string
+	rejectFileFlag  string
+
+	dryRun         bool
+	reportFileFlag string
+
+	metricsAddr string
+)
+
+// Exit codes returned by handleMerchant and passed to os.Exit by main, so
+// that a run with row errors (including rows that errored because Ctrl-C
+// cancelled them mid-flight) is reported as a failure.
+const (
+	exitOK        = 0
+	exitRowErrors = 1
 )
 
 func configConnection(db *gorm.DB) error {
@@ -50,8 +75,8 @@ func configConnection(db *gorm.DB) error {
 	return nil
 }
 
-func newDB() (*gorm.DB, error) {
-	logrus.Debug("Coming Create Storage")
+func newDB(log *logrus.Logger) (*gorm.DB, error) {
+	log.Debug("Coming Create Storage")
 
 	db, err := gorm.Open(mysql.Open(viper.GetString("db.dsn")), &gorm.Config{})
 	if err != nil {
@@ -65,34 +90,42 @@ func newDB() (*gorm.DB, error) {
 	return db, nil
 }
 
-func updateBranchCount(db *gorm.DB, retailerID int64, branchCount *int32) error {
-	merchant := new(Merchant)
-
-	cond := clause.Eq{Column: "retailer_id", Value: retailerID}
-
-	if err := db.Table(tableName).Clauses(cond).Take(merchant).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			logrus.Infof("Retailer ID %d not found", retailerID)
-			return nil
-		}
-		return err
+// buildOnConflict returns the bulk-upsert clause used to apply a batch of
+// merchants in a single statement instead of one SELECT+UPDATE round-trip
+// per row. DoUpdates keeps the original "only set if NULL" semantics with
+// a conditional IF(), not a Where predicate: gorm's MySQL dialector never
+// reads clause.OnConflict.Where when it builds "ON DUPLICATE KEY UPDATE"
+// SQL, so a Where clause here is silently dropped and would overwrite rows
+// whose branch_count is already set. Callers must also only pass rows
+// whose retailer_id is already known to exist (see
+// filterExistingMerchants) - ON CONFLICT's insert path is not meant to
+// create new merchant rows from this script.
+func buildOnConflict() clause.OnConflict {
+	return clause.OnConflict{
+		Columns: []clause.Column{{Name: "retailer_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			columnName: gorm.Expr("IF(`" + columnName + "` IS NULL, VALUES(`" + columnName + "`), `" + columnName + "`)"),
+		}),
 	}
-
-	if merchant.BranchCount == nil {
-		logrus.Infof("Update branch count to %d", *branchCount)
-		if err := db.Table(tableName).Clauses(cond).Update(columnName, *branchCount).Error; err != nil {
-			return err
-		}
-	} else {
-		logrus.Infof("Branch count already set to %d", *merchant.BranchCount)
-	}
-
-	return nil
 }
 
 func init() {
+	// go test builds this package directly (it has no internal_test
+	// package split), so this init would otherwise run flag.Parse and
+	// require a config file for every test binary too.
+	if testing.Testing() {
+		return
+	}
+
 	var pathConfig string
 	flag.StringVar(&pathConfig, "config", "config.yaml", "path to config file")
+	flag.BoolVar(&resume, "resume", false, "resume a previous run from its checkpoint file")
+	flag.StringVar(&inputFileFlag, "input-file", "", "path to the input file, ignored for --input-format stdin (overrides input.path, default retail.csv)")
+	flag.StringVar(&inputFormatFlag, "input-format", "", "input format: csv, jsonl, or stdin (overrides input.format)")
+	flag.StringVar(&rejectFileFlag, "reject-file", "", "path to write rows that fail parsing/validation (overrides input.reject_file)")
+	flag.BoolVar(&dryRun, "dry-run", false, "plan updates and write a report without issuing any UPDATE")
+	flag.StringVar(&reportFileFlag, "report-file", "", "dry-run report path, .csv or .json (overrides dry_run.report_file)")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve Prometheus /metrics on, e.g. :9090 (empty disables)")
 	flag.Parse()
 
 	err := readConfig(pathConfig)
@@ -108,96 +141,242 @@ func readConfig(pathConfig string) error {
 	return viper.ReadInConfig()
 }
 
-func fileLoader(pipe chan<- Merchant, wg *sync.WaitGroup) error {
+func fileLoader(ctx context.Context, pipe chan<- Merchant, wg *sync.WaitGroup, ckpt Checkpointer, log *logrus.Logger, src InputSource, reject *rejectSink) error {
 	defer wg.Done()
-
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
 	defer func() {
-		err = file.Close()
-		if err != nil {
-			logrus.Errorf("Cannot close file with error: %+v", err)
+		if err := src.Close(); err != nil {
+			log.Errorf("Cannot close input source with error: %+v", err)
 		}
 	}()
 
-	var merchant Merchant
-	reader := csv.NewReader(file)
 	for {
-		line, err := reader.Read()
-		if err == io.EOF {
+		select {
+		case <-ctx.Done():
+			log.Warn("Context cancelled, stopping file load")
+			return ctx.Err()
+		default:
+		}
+
+		merchant, err := src.Next()
+		if errors.Is(err, io.EOF) {
 			break
 		}
-		if err != nil {
-			return err
+		rowsRead.Inc()
+
+		// Checked before the recErr/validateMerchant branches below so a
+		// row already rejected (and thus already checkpointed) on a prior
+		// run is skipped outright on --resume, instead of being re-parsed
+		// and re-appended to the reject file every time.
+		if ckpt.Done(merchant.Offset) {
+			log.WithField("offset", merchant.Offset).Info("Skipping already committed row")
+			continue
 		}
 
-		retailerID, err := strconv.ParseInt(line[0], 10, 64)
-		if err != nil {
-			logrus.Errorf("Error parser Retailer ID: %+v", err)
-			return err
+		var recErr *recordError
+		if errors.As(err, &recErr) {
+			log.WithField("offset", merchant.Offset).Warnf("Rejecting malformed row: %s", recErr.reason)
+			if rejErr := reject.Reject(merchant.Offset, recErr.raw, recErr.reason); rejErr != nil {
+				log.Errorf("Cannot write reject record: %+v", rejErr)
+			}
+			if err := ckpt.Commit(merchant.Offset, merchant.RetailerID); err != nil {
+				log.Errorf("Cannot commit checkpoint for offset %d: %+v", merchant.Offset, err)
+			}
+			continue
 		}
-
-		branchCountInt64, err := strconv.ParseInt(line[1], 10, 64)
 		if err != nil {
-			logrus.Errorf("Error parser Branch Count: %+v", err)
 			return err
 		}
-		branchCount := int32(branchCountInt64)
 
-		merchant.BranchCount = &branchCount
-		merchant.RetailerID = retailerID
+		if err := validateMerchant(merchant); err != nil {
+			log.WithField("offset", merchant.Offset).Warnf("Rejecting invalid row: %s", err)
+			raw := fmt.Sprintf("retailer_id=%d branch_count=%s", merchant.RetailerID, formatBranchCount(merchant.BranchCount))
+			if rejErr := reject.Reject(merchant.Offset, raw, err.Error()); rejErr != nil {
+				log.Errorf("Cannot write reject record: %+v", rejErr)
+			}
+			if err := ckpt.Commit(merchant.Offset, merchant.RetailerID); err != nil {
+				log.Errorf("Cannot commit checkpoint for offset %d: %+v", merchant.Offset, err)
+			}
+			continue
+		}
 
-		pipe <- merchant
+		select {
+		case pipe <- merchant:
+		case <-ctx.Done():
+			log.Warn("Context cancelled, stopping file load")
+			return ctx.Err()
+		}
 	}
 
 	return nil
 }
 
-func handleMerchant() {
-	db, err := newDB()
+func handleMerchant() int {
+	log, err := newLogger()
 	if err != nil {
-		logrus.Error(err)
+		logrus.Fatalf("Failed to set up logger: %+v", err)
 	}
 
-	var wg sync.WaitGroup
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	pipe := make(chan Merchant)
-	done := make(chan bool)
+	go serveMetrics(ctx, metricsAddr, log)
 
-	go func() {
-		for {
-			merchant, more := <-pipe
-			if more {
-				logrus.Infof("Handle update branch count merchant with retailer id %d", merchant.RetailerID)
-				if err := updateBranchCount(db, merchant.RetailerID, merchant.BranchCount); err != nil {
-					logrus.Error(err)
-				}
-			} else {
-				logrus.Info("Done")
-				done <- true
-				return
-			}
+	if inputFileFlag != "" {
+		filePath = inputFileFlag
+	} else if cfgPath := viper.GetString("input.path"); cfgPath != "" {
+		filePath = cfgPath
+	}
+
+	db, err := newDB(log)
+	if err != nil {
+		log.Error(err)
+	}
+	defer func() {
+		sqlDB, err := db.DB()
+		if err != nil {
+			log.Errorf("Cannot get underlying DB connection to close it: %+v", err)
+			return
+		}
+		if err := sqlDB.Close(); err != nil {
+			log.Errorf("Cannot close DB pool: %+v", err)
+		}
+	}()
+
+	ckpt, err := newCheckpointer(resume, filePath)
+	if err != nil {
+		log.Fatalf("Failed to open checkpoint file: %+v", err)
+	}
+	defer func() {
+		if err := ckpt.Close(); err != nil {
+			log.Errorf("Cannot close checkpoint file with error: %+v", err)
+		}
+	}()
+
+	batchSize := viper.GetInt("db.batch_size")
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	workers := viper.GetInt("db.workers")
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	limiter := newLimiter(viper.GetFloat64("db.qps"))
+
+	maxRetries := viper.GetInt("db.max_retries")
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
+	backoffBase := viper.GetDuration("db.backoff_base")
+	if backoffBase <= 0 {
+		backoffBase = defaultBackoffBase
+	}
+
+	backoffMax := viper.GetDuration("db.backoff_max")
+	if backoffMax <= 0 {
+		backoffMax = defaultBackoffMax
+	}
+
+	retryCfg := retryConfig{maxRetries: maxRetries, backoffBase: backoffBase, backoffMax: backoffMax}
+
+	format := inputFormatFlag
+	if format == "" {
+		format = viper.GetString("input.format")
+	}
+
+	src, err := newInputSource(format, filePath)
+	if err != nil {
+		log.Fatalf("Failed to open input source: %+v", err)
+	}
+
+	rejectPath := rejectFileFlag
+	if rejectPath == "" {
+		rejectPath = viper.GetString("input.reject_file")
+	}
+
+	reject, err := newRejectSink(rejectPath)
+	if err != nil {
+		log.Fatalf("Failed to open reject file: %+v", err)
+	}
+	defer func() {
+		if err := reject.Close(); err != nil {
+			log.Errorf("Cannot close reject file with error: %+v", err)
 		}
 	}()
 
-	wg.Add(1)
+	var loadWg sync.WaitGroup
+
+	pipe := make(chan Merchant)
+	batches := make(chan Batch)
+
+	loadWg.Add(1)
 
 	go func() {
-		err := fileLoader(pipe, &wg)
+		err := fileLoader(ctx, pipe, &loadWg, ckpt, log, src, reject)
 		if err != nil {
-			logrus.Errorf("Error when load file: %+v", err)
+			log.Errorf("Error when load file: %+v", err)
 		}
 	}()
 
 	go func() {
-		wg.Wait()
+		loadWg.Wait()
 		close(pipe)
 	}()
-	<-done
+
+	go batchMerchants(pipe, batches, batchSize)
+
+	var workerWg sync.WaitGroup
+	workerWg.Add(workers)
+
+	if dryRun {
+		reportPath := reportFileFlag
+		if reportPath == "" {
+			reportPath = viper.GetString("dry_run.report_file")
+		}
+
+		report, err := newReportSink(reportPath)
+		if err != nil {
+			log.Fatalf("Failed to open dry-run report file: %+v", err)
+		}
+		defer func() {
+			if err := report.Close(); err != nil {
+				log.Errorf("Cannot close dry-run report file with error: %+v", err)
+			}
+		}()
+
+		for i := 0; i < workers; i++ {
+			go dryRunWorker(ctx, db, batches, report, &workerWg, log, limiter)
+		}
+		workerWg.Wait()
+
+		log.Info("Dry run complete")
+		return exitOK
+	}
+
+	aimd := newAdaptiveConcurrency(workers)
+	go aimd.rampLoop(ctx)
+
+	var stats runStats
+	for i := 0; i < workers; i++ {
+		go worker(ctx, db, batches, ckpt, &stats, &workerWg, log, limiter, retryCfg, aimd)
+	}
+	workerWg.Wait()
+
+	log.WithFields(logrus.Fields{
+		"updated": stats.updated,
+		"skipped": stats.skipped,
+		"errored": stats.errored,
+	}).Info("Batch run summary")
+
+	if stats.errored > 0 {
+		return exitRowErrors
+	}
+
+	return exitOK
 }
 
 func main() {
-	handleMerchant()
+	os.Exit(handleMerchant())
 }
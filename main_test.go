@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sliceInputSource replays a fixed list of (Merchant, error) results, so a
+// test can run fileLoader twice over "the same input" without re-parsing a
+// file, to simulate a --resume run.
+type sliceInputSource struct {
+	rows []Merchant
+	errs []error
+	i    int
+}
+
+func (s *sliceInputSource) Next() (Merchant, error) {
+	if s.i >= len(s.rows) {
+		return Merchant{}, io.EOF
+	}
+	m, err := s.rows[s.i], s.errs[s.i]
+	s.i++
+	return m, err
+}
+
+func (s *sliceInputSource) Close() error { return nil }
+
+func newMalformedRowSource() *sliceInputSource {
+	return &sliceInputSource{
+		rows: []Merchant{
+			{Offset: 0},
+			{Offset: 1, RetailerID: 1, BranchCount: int32Ptr(5)},
+		},
+		errs: []error{
+			&recordError{raw: "bogus", reason: "malformed CSV row"},
+			nil,
+		},
+	}
+}
+
+func int32Ptr(v int32) *int32 { return &v }
+
+func runFileLoader(t *testing.T, ckpt Checkpointer, reject *rejectSink, src InputSource) []Merchant {
+	t.Helper()
+
+	log := discardLogger()
+	pipe := make(chan Merchant, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	if err := fileLoader(context.Background(), pipe, &wg, ckpt, log, src, reject); err != nil {
+		t.Fatalf("fileLoader: %v", err)
+	}
+	close(pipe)
+
+	var got []Merchant
+	for m := range pipe {
+		got = append(got, m)
+	}
+	return got
+}
+
+// TestFileLoaderDoesNotDuplicateRejectsOnResume reproduces a --resume run
+// over the same input: the malformed row at offset 0 must be checkpointed
+// the first time it's rejected, so a second pass (the resumed run) skips it
+// instead of rejecting it again and appending a duplicate line to the
+// reject file.
+func TestFileLoaderDoesNotDuplicateRejectsOnResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.csv")
+	rejectPath := filepath.Join(t.TempDir(), "rejects.csv")
+
+	ckpt, err := newFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("newFileCheckpointer: %v", err)
+	}
+	defer ckpt.Close()
+
+	reject, err := newRejectSink(rejectPath)
+	if err != nil {
+		t.Fatalf("newRejectSink: %v", err)
+	}
+	defer reject.Close()
+
+	got := runFileLoader(t, ckpt, reject, newMalformedRowSource())
+	if len(got) != 1 || got[0].RetailerID != 1 {
+		t.Fatalf("first run: got %+v, want only the valid row at offset 1", got)
+	}
+
+	if !ckpt.Done(0) {
+		t.Fatal("offset 0 (the rejected row) must be checkpointed as Done after being rejected")
+	}
+
+	resumed, err := newFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("newFileCheckpointer on resume: %v", err)
+	}
+	defer resumed.Close()
+
+	got = runFileLoader(t, resumed, reject, newMalformedRowSource())
+	if len(got) != 1 || got[0].RetailerID != 1 {
+		t.Fatalf("resumed run: got %+v, want only the valid row at offset 1 (offset 0 must be skipped, not re-rejected)", got)
+	}
+
+	rejectContents, err := os.ReadFile(rejectPath)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	lines := strings.Split(strings.TrimRight(string(rejectContents), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Errorf("reject file has %d lines after resume, want 1 (no duplicate reject record): %q", len(lines), rejectContents)
+	}
+}
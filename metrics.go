@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	rowsRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "update_branch_rows_read_total",
+		Help: "Total number of rows read from the input source.",
+	})
+	rowsUpdated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "update_branch_rows_updated_total",
+		Help: "Total number of rows whose branch_count was updated.",
+	})
+	rowsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "update_branch_rows_skipped_total",
+		Help: "Total number of rows skipped, by reason.",
+	}, []string{"reason"})
+	rowErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "update_branch_row_errors_total",
+		Help: "Total number of row errors, by class.",
+	}, []string{"class"})
+	dbLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "update_branch_db_latency_seconds",
+		Help:    "Latency of a single batch UPSERT statement.",
+		Buckets: prometheus.DefBuckets,
+	})
+	batchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "update_branch_batch_duration_seconds",
+		Help:    "End-to-end duration of applying one batch, including checkpointing.",
+		Buckets: prometheus.DefBuckets,
+	})
+	dbRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "update_branch_db_retries_total",
+		Help: "Total number of batch UPSERT retries after a transient MySQL error, by class.",
+	}, []string{"class"})
+	concurrencyLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "update_branch_concurrency_limit",
+		Help: "Current effective concurrency allowed by the AIMD controller.",
+	})
+)
+
+// serveMetrics starts the Prometheus /metrics endpoint on addr and runs it
+// until ctx is cancelled. It is a no-op when addr is empty, which keeps
+// the endpoint opt-in.
+func serveMetrics(ctx context.Context, addr string, log *logrus.Logger) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Errorf("Error closing metrics server: %+v", err)
+		}
+	}()
+
+	log.Infof("Serving metrics on %s/metrics", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Metrics server error: %+v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultMaxRetries  = 3
+	defaultBackoffBase = 100 * time.Millisecond
+	defaultBackoffMax  = 5 * time.Second
+
+	mysqlErrDeadlock        = 1213
+	mysqlErrLockWaitTimeout = 1205
+
+	// aimdCooldown is how long the adaptive controller waits after a
+	// deadlock before it starts ramping concurrency back up.
+	aimdCooldown = 30 * time.Second
+	// aimdRampInterval is how often the controller adds one unit of
+	// concurrency back once the cooldown window has passed.
+	aimdRampInterval = 10 * time.Second
+	// aimdFloor is the minimum concurrency the controller will back off
+	// to, so a run under heavy lock contention still makes progress.
+	aimdFloor = 1
+)
+
+// retryConfig holds the db.max_retries, db.backoff_base and db.backoff_max
+// knobs that govern withRetry.
+type retryConfig struct {
+	maxRetries  int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+}
+
+// newLimiter builds the token-bucket limiter used to cap the rate of
+// UPSERT statements issued against MySQL, from db.qps. qps <= 0 disables
+// limiting, which keeps the previous unbounded-throughput behavior as the
+// default.
+func newLimiter(qps float64) *rate.Limiter {
+	if qps <= 0 {
+		return nil
+	}
+
+	burst := int(qps)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return rate.NewLimiter(rate.Limit(qps), burst)
+}
+
+// classifyTransientError maps a transient MySQL error to the metric label
+// and log field used to report it. Errors that are not recognized as
+// transient are reported as "" and must not be retried.
+func classifyTransientError(err error) string {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case mysqlErrDeadlock:
+			return "deadlock"
+		case mysqlErrLockWaitTimeout:
+			return "lock_wait_timeout"
+		}
+		return ""
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return "conn_reset"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || strings.Contains(err.Error(), "connection reset") {
+		return "conn_reset"
+	}
+
+	return ""
+}
+
+// withRetry runs fn, retrying up to cfg.maxRetries times with exponential
+// backoff (base, 2*base, 4*base, ... capped at backoffMax, plus jitter) on
+// the classic transient MySQL failures: deadlock (1213), lock wait timeout
+// (1205), and dropped connections. Every deadlock is reported to aimd so
+// the adaptive concurrency controller can back off. Non-transient errors
+// and context cancellation return immediately without retrying.
+func withRetry(ctx context.Context, cfg retryConfig, aimd *adaptiveConcurrency, log *logrus.Logger, batchID int64, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		class := classifyTransientError(err)
+		if class == "" {
+			return err
+		}
+
+		dbRetries.WithLabelValues(class).Inc()
+		if class == "deadlock" {
+			aimd.onDeadlock()
+		}
+
+		if attempt >= cfg.maxRetries {
+			return err
+		}
+
+		backoff := cfg.backoffBase * time.Duration(int64(1)<<uint(attempt))
+		if backoff <= 0 || backoff > cfg.backoffMax {
+			backoff = cfg.backoffMax
+		}
+		backoff += time.Duration(rand.Int63n(int64(backoff/4) + 1))
+
+		log.WithFields(logrus.Fields{
+			"batch_id": batchID,
+			"attempt":  attempt + 1,
+			"class":    class,
+		}).Warnf("Retrying batch after transient MySQL error: %+v", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// adaptiveConcurrency is an AIMD controller gating how many batch UPSERTs
+// may be in flight at once. A deadlock halves the limit (floored at
+// aimdFloor) and opens a cooldown window; once the window passes without
+// a further deadlock, the limit is grown back by one every
+// aimdRampInterval until it reaches ceiling again. This keeps the worker
+// pool's goroutine count fixed while still shedding load on a MySQL that
+// is under lock pressure.
+type adaptiveConcurrency struct {
+	mu            sync.Mutex
+	waiters       list.List
+	inFlight      int
+	limit         int
+	ceiling       int
+	cooldownUntil time.Time
+}
+
+func newAdaptiveConcurrency(ceiling int) *adaptiveConcurrency {
+	if ceiling < 1 {
+		ceiling = 1
+	}
+
+	a := &adaptiveConcurrency{limit: ceiling, ceiling: ceiling}
+	concurrencyLimit.Set(float64(ceiling))
+
+	return a
+}
+
+// acquire blocks until a concurrency slot is available or ctx is done.
+func (a *adaptiveConcurrency) acquire(ctx context.Context) error {
+	a.mu.Lock()
+	if a.inFlight < a.limit {
+		a.inFlight++
+		a.mu.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	elem := a.waiters.PushBack(ready)
+	a.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		a.handleCancelledWait(elem, ready)
+		return ctx.Err()
+	}
+}
+
+// handleCancelledWait resolves the race between ctx being cancelled and a
+// concurrent release granting this exact waiter: if ready was already
+// closed (the grant won the race), the slot just acquired is handed
+// straight back via release so it isn't leaked; otherwise the waiter is
+// simply removed from the queue.
+func (a *adaptiveConcurrency) handleCancelledWait(elem *list.Element, ready <-chan struct{}) {
+	a.mu.Lock()
+	select {
+	case <-ready:
+		a.mu.Unlock()
+		a.release()
+	default:
+		a.waiters.Remove(elem)
+		a.mu.Unlock()
+	}
+}
+
+// release returns a concurrency slot, waking the oldest waiter if the
+// current limit allows it.
+func (a *adaptiveConcurrency) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inFlight--
+	a.wakeWaitersLocked()
+}
+
+func (a *adaptiveConcurrency) wakeWaitersLocked() {
+	for a.inFlight < a.limit {
+		front := a.waiters.Front()
+		if front == nil {
+			return
+		}
+		a.waiters.Remove(front)
+		a.inFlight++
+		close(front.Value.(chan struct{}))
+	}
+}
+
+// onDeadlock performs the AIMD multiplicative decrease: halve the limit
+// and open a cooldown window during which rampLoop will not grow it back.
+func (a *adaptiveConcurrency) onDeadlock() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	newLimit := a.limit / 2
+	if newLimit < aimdFloor {
+		newLimit = aimdFloor
+	}
+	if newLimit < a.limit {
+		a.limit = newLimit
+		concurrencyLimit.Set(float64(a.limit))
+	}
+	a.cooldownUntil = time.Now().Add(aimdCooldown)
+}
+
+// rampLoop performs the AIMD additive increase, growing the limit back
+// toward ceiling one step at a time once the cooldown window has passed.
+// It runs until ctx is done.
+func (a *adaptiveConcurrency) rampLoop(ctx context.Context) {
+	ticker := time.NewTicker(aimdRampInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.rampStep()
+		}
+	}
+}
+
+// rampStep performs a single AIMD additive-increase step: it grows the
+// limit by one, toward ceiling, if the cooldown window opened by the last
+// onDeadlock has passed. Split out of rampLoop's ticker body so it can be
+// driven directly in tests instead of waiting on aimdRampInterval.
+func (a *adaptiveConcurrency) rampStep() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.limit < a.ceiling && time.Now().After(a.cooldownUntil) {
+		a.limit++
+		concurrencyLimit.Set(float64(a.limit))
+		a.wakeWaitersLocked()
+	}
+}
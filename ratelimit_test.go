@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+func discardLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func TestAdaptiveConcurrencyAcquireBlocksAtLimitAndReleaseUnblocks(t *testing.T) {
+	a := newAdaptiveConcurrency(1)
+	ctx := context.Background()
+
+	if err := a.acquire(ctx); err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- a.acquire(ctx)
+	}()
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("second acquire returned early (err=%v) instead of blocking at limit", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	a.release()
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("second acquire: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("release did not wake the blocked waiter")
+	}
+}
+
+func TestAdaptiveConcurrencyReleaseWakesOldestWaiterFirst(t *testing.T) {
+	a := newAdaptiveConcurrency(1)
+	if err := a.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	var readies []chan struct{}
+	a.mu.Lock()
+	for i := 0; i < 3; i++ {
+		ready := make(chan struct{})
+		a.waiters.PushBack(ready)
+		readies = append(readies, ready)
+	}
+	a.mu.Unlock()
+
+	a.release()
+
+	select {
+	case <-readies[0]:
+	default:
+		t.Fatal("release did not grant the oldest (first-queued) waiter")
+	}
+	for i, ready := range readies[1:] {
+		select {
+		case <-ready:
+			t.Fatalf("waiter %d was granted out of FIFO order", i+1)
+		default:
+		}
+	}
+}
+
+func TestAdaptiveConcurrencyHandleCancelledWaitRemovesPendingWaiter(t *testing.T) {
+	a := newAdaptiveConcurrency(1)
+	if err := a.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	ready := make(chan struct{})
+	a.mu.Lock()
+	elem := a.waiters.PushBack(ready)
+	a.mu.Unlock()
+
+	a.handleCancelledWait(elem, ready)
+
+	a.mu.Lock()
+	waiting := a.waiters.Len()
+	inFlight := a.inFlight
+	a.mu.Unlock()
+
+	if waiting != 0 {
+		t.Errorf("waiter still queued after cancellation: len = %d, want 0", waiting)
+	}
+	if inFlight != 1 {
+		t.Errorf("inFlight changed for a waiter that was never granted: got %d, want 1", inFlight)
+	}
+}
+
+// TestAdaptiveConcurrencyHandleCancelledWaitReturnsGrantedSlot exercises
+// the race acquire's ctx.Done() branch must handle: ctx is cancelled at
+// the same moment a concurrent release grants this exact waiter. The slot
+// must be handed back, not leaked.
+func TestAdaptiveConcurrencyHandleCancelledWaitReturnsGrantedSlot(t *testing.T) {
+	a := newAdaptiveConcurrency(1)
+	if err := a.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	ready := make(chan struct{})
+	a.mu.Lock()
+	elem := a.waiters.PushBack(ready)
+	a.mu.Unlock()
+
+	// Simulate a concurrent release() granting this exact waiter: it
+	// pops the waiter, bumps inFlight back up, and closes ready - the
+	// same thing the real release path does.
+	a.release()
+
+	select {
+	case <-ready:
+	default:
+		t.Fatal("setup error: simulated release did not close ready")
+	}
+
+	a.handleCancelledWait(elem, ready)
+
+	a.mu.Lock()
+	inFlight := a.inFlight
+	waiting := a.waiters.Len()
+	a.mu.Unlock()
+
+	if inFlight != 0 {
+		t.Errorf("handleCancelledWait did not give the granted slot back: inFlight = %d, want 0", inFlight)
+	}
+	if waiting != 0 {
+		t.Errorf("waiters queue should be empty, got %d", waiting)
+	}
+}
+
+func TestAdaptiveConcurrencyOnDeadlockHalvesAndFloors(t *testing.T) {
+	a := newAdaptiveConcurrency(8)
+
+	for _, want := range []int{4, 2, 1, 1} {
+		a.onDeadlock()
+
+		a.mu.Lock()
+		got := a.limit
+		cooldown := a.cooldownUntil
+		a.mu.Unlock()
+
+		if got != want {
+			t.Fatalf("after onDeadlock: limit = %d, want %d", got, want)
+		}
+		if !cooldown.After(time.Now()) {
+			t.Fatalf("onDeadlock did not open a cooldown window")
+		}
+	}
+}
+
+func TestAdaptiveConcurrencyRampStepGrowsOnlyAfterCooldownAndStopsAtCeiling(t *testing.T) {
+	a := newAdaptiveConcurrency(4)
+	a.mu.Lock()
+	a.limit = 1
+	a.cooldownUntil = time.Now().Add(time.Hour)
+	a.mu.Unlock()
+
+	a.rampStep()
+
+	a.mu.Lock()
+	got := a.limit
+	a.mu.Unlock()
+	if got != 1 {
+		t.Fatalf("rampStep grew the limit during the cooldown window: got %d, want 1", got)
+	}
+
+	a.mu.Lock()
+	a.cooldownUntil = time.Now().Add(-time.Minute)
+	a.mu.Unlock()
+
+	a.rampStep()
+
+	a.mu.Lock()
+	got = a.limit
+	a.mu.Unlock()
+	if got != 2 {
+		t.Fatalf("rampStep did not grow the limit once cooldown elapsed: got %d, want 2", got)
+	}
+
+	for i := 0; i < 10; i++ {
+		a.rampStep()
+	}
+
+	a.mu.Lock()
+	got = a.limit
+	a.mu.Unlock()
+	if got != a.ceiling {
+		t.Fatalf("rampStep grew past ceiling: limit = %d, ceiling = %d", got, a.ceiling)
+	}
+}
+
+func TestClassifyTransientError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"deadlock", &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "Deadlock found"}, "deadlock"},
+		{"lock_wait_timeout", &mysql.MySQLError{Number: mysqlErrLockWaitTimeout, Message: "Lock wait timeout exceeded"}, "lock_wait_timeout"},
+		{"other_mysql_error", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, ""},
+		{"bad_conn", driver.ErrBadConn, "conn_reset"},
+		{"connection_reset_message", errors.New("write: connection reset by peer"), "conn_reset"},
+		{"generic_error", errors.New("boom"), ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := classifyTransientError(c.err); got != c.want {
+				t.Errorf("classifyTransientError(%v) = %q, want %q", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestWithRetrySucceedsAfterTransientError(t *testing.T) {
+	cfg := retryConfig{maxRetries: 3, backoffBase: time.Millisecond, backoffMax: 5 * time.Millisecond}
+	aimd := newAdaptiveConcurrency(1)
+
+	attempts := 0
+	err := withRetry(context.Background(), cfg, aimd, discardLogger(), 1, func() error {
+		attempts++
+		if attempts < 2 {
+			return &mysql.MySQLError{Number: mysqlErrLockWaitTimeout, Message: "lock wait timeout"}
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("withRetry: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	cfg := retryConfig{maxRetries: 2, backoffBase: time.Millisecond, backoffMax: 5 * time.Millisecond}
+	aimd := newAdaptiveConcurrency(1)
+
+	attempts := 0
+	err := withRetry(context.Background(), cfg, aimd, discardLogger(), 1, func() error {
+		attempts++
+		return &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "deadlock"}
+	})
+
+	if attempts != cfg.maxRetries+1 {
+		t.Errorf("attempts = %d, want %d", attempts, cfg.maxRetries+1)
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		t.Errorf("withRetry did not return the last transient error: %v", err)
+	}
+}
+
+func TestWithRetryDoesNotRetryNonTransientErrors(t *testing.T) {
+	cfg := retryConfig{maxRetries: 3, backoffBase: time.Millisecond, backoffMax: 5 * time.Millisecond}
+	aimd := newAdaptiveConcurrency(1)
+
+	wantErr := errors.New("not transient")
+	attempts := 0
+	err := withRetry(context.Background(), cfg, aimd, discardLogger(), 1, func() error {
+		attempts++
+		return wantErr
+	})
+
+	if !errors.Is(err, wantErr) {
+		t.Errorf("withRetry returned %v, want %v", err, wantErr)
+	}
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1 (non-transient errors are not retried)", attempts)
+	}
+}
+
+func TestWithRetryReportsDeadlocksToAdaptiveConcurrency(t *testing.T) {
+	cfg := retryConfig{maxRetries: 1, backoffBase: time.Millisecond, backoffMax: time.Millisecond}
+	aimd := newAdaptiveConcurrency(4)
+
+	_ = withRetry(context.Background(), cfg, aimd, discardLogger(), 1, func() error {
+		return &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "deadlock"}
+	})
+
+	aimd.mu.Lock()
+	limit := aimd.limit
+	aimd.mu.Unlock()
+
+	if limit >= 4 {
+		t.Errorf("a deadlock in withRetry did not trigger onDeadlock: limit = %d, want < 4", limit)
+	}
+}